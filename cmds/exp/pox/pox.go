@@ -29,6 +29,36 @@
 //     create|c: create the TCZ file.
 //     zip|z: Use zip and unzip instead of a loopback mounted squashfs.  Be sure
 //            to use -z for both creation and running, or not at all.
+//     target: squashfs (default), or vm to build/run a bootable raw disk image
+//             instead of a squashfs.
+//     size: size of the disk image when target is vm (default 512M).
+//     fs: filesystem to format the vm disk image with (default ext4).
+//     userns: Run without sudo by re-execing pox into a new user, mount and
+//             pid namespace, mapping the calling user to root inside it
+//             before doing the bind mounts and chroot.  Requires --zip:
+//             loop-mounting a squashfs or --target=vm image needs real
+//             CAP_SYS_ADMIN over the host's loop devices, which a new user
+//             namespace does not grant.
+//     dev: How to populate the chroot's /dev: bind (default, bind mount the
+//          host's /dev), minimal (mknod just null/zero/full/random/urandom/
+//          tty/console, plus the loop device for a vm pox), or none.
+//     timeout: Cancel the create/run and unwind all mounts after this long
+//              (default 0, no timeout).  SIGINT and SIGTERM cancel the same
+//              way, so Ctrl-C always leaves mounts and loop devices clean.
+//     template: Path to a YAML manifest of template files to render into the
+//               pox in addition to the files listed on the command line, e.g.
+//                   templates:
+//                   - source: hostname.tmpl
+//                     target: /etc/hostname
+//                     mode: 0644
+//                     when: [create]
+//               Each entry's source is a Go text/template file, relative to
+//               the manifest, rendered with {{.Pox.Name}}, {{.Host.Arch}},
+//               {{.Env.USER}} and, from that entry's own "properties:" map,
+//               {{.Properties.foo}}-style variables.  "when: [create]" entries are
+//               rendered once, while building the pox; "when: [run]" entries
+//               are rendered fresh into a tmpfs every time the pox runs, so
+//               e.g. /etc/resolv.conf can pick up the current host's values.
 //     Exactly one of -c and -r must be used on the same command.
 //
 // Example:
@@ -76,33 +106,111 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
+	"text/template"
 
 	flag "github.com/spf13/pflag"
 	"github.com/u-root/u-root/pkg/ldd"
 	"github.com/u-root/u-root/pkg/loop"
 	"github.com/u-root/u-root/pkg/mount"
+	"golang.org/x/sys/unix"
+	yaml "gopkg.in/yaml.v2"
 )
 
 const usage = "pox [-[-debug]|d] -[-run|r] | -[-create]|c  [-[-file]|f tcz-file] file [...file]"
 
 var (
-	debug  = flag.BoolP("debug", "d", false, "enable debug prints")
-	run    = flag.BoolP("run", "r", false, "Run the first file argument")
-	create = flag.BoolP("create", "c", false, "create it")
-	zip    = flag.BoolP("zip", "z", false, "use zip instead of squashfs")
-	file   = flag.StringP("output", "f", "/tmp/pox.tcz", "Output file")
-	v      = func(string, ...interface{}) {}
+	debug        = flag.BoolP("debug", "d", false, "enable debug prints")
+	run          = flag.BoolP("run", "r", false, "Run the first file argument")
+	create       = flag.BoolP("create", "c", false, "create it")
+	zip          = flag.BoolP("zip", "z", false, "use zip instead of squashfs")
+	file         = flag.StringP("output", "f", "/tmp/pox.tcz", "Output file")
+	target       = flag.String("target", "squashfs", "Output format: squashfs or vm")
+	size         = flag.String("size", "512M", "Size of the disk image, for --target=vm")
+	fs           = flag.String("fs", "ext4", "Filesystem for the disk image, for --target=vm")
+	userns       = flag.Bool("userns", false, "Run without sudo, in a new user+mount namespace")
+	dev          = flag.String("dev", "bind", "How to populate the chroot's /dev: bind, minimal, or none")
+	timeout      = flag.Duration("timeout", 0, "Cancel and unwind all mounts after this long (0 disables)")
+	tmplManifest = flag.String("template", "", "YAML manifest of template files to render into the pox")
+	v            = func(string, ...interface{}) {}
 )
 
+// childArgv0 is the argv[0] poxRunUserns re-execs itself as; main looks for
+// it to decide whether it's the parent or the re-exec'd "child" process
+// running as root inside the new user namespace.
+const childArgv0 = "pox-child"
+
+// Environment variables used to hand the child, which doesn't go through
+// flag.Parse() itself (argv[0] == childArgv0), the settings it needs to
+// mount and chroot into the pox.
+const (
+	envFile   = "POX_FILE"
+	envZip    = "POX_ZIP"
+	envTarget = "POX_TARGET"
+	envFS     = "POX_FS"
+	envDev    = "POX_DEV"
+)
+
+// targetVM is true when pox should build or run a bootable raw disk image
+// instead of a squashfs.
+func targetVM() bool {
+	return *target == "vm"
+}
+
+// quantity parses a size string such as "512M" or "2G" into a number of
+// bytes, as accepted by the --size flag.  It returns an error for anything
+// that isn't a plain number optionally followed by a single K, M or G
+// suffix, rather than silently parsing a prefix of the string.
+func quantity(s string) (int64, error) {
+	orig := s
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult, s = 1<<10, strings.TrimSuffix(s, "K")
+	case strings.HasSuffix(s, "M"):
+		mult, s = 1<<20, strings.TrimSuffix(s, "M")
+	case strings.HasSuffix(s, "G"):
+		mult, s = 1<<30, strings.TrimSuffix(s, "G")
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("--size %q: must be a number optionally followed by K, M or G", orig)
+	}
+	return n * mult, nil
+}
+
+// cleanupStack tracks teardown steps (unmounts, loop frees, temp dir
+// removal) in the order they were taken. run unwinds them in reverse, last
+// mounted first unmounted, so a SIGINT/SIGTERM cancellation partway through
+// a create or run still leaves no mounts or loop devices behind.
+type cleanupStack struct {
+	steps []func() error
+}
+
+func (c *cleanupStack) push(step func() error) {
+	c.steps = append(c.steps, step)
+}
+
+func (c *cleanupStack) run() {
+	for i := len(c.steps) - 1; i >= 0; i-- {
+		if err := c.steps[i](); err != nil {
+			v("cleanup: %v", err)
+		}
+	}
+}
+
 // When chrooting, programs often want to access various system directories:
 var chrootMounts = []struct {
 	source string
@@ -116,11 +224,263 @@ var chrootMounts = []struct {
 	{"/sys", "/sys", "", mount.MS_BIND, "", 0555},
 	// mount -t proc /proc /chroot/proc
 	{"/proc", "/proc", "proc", 0, "", 0555},
-	// mount --bind /dev /chroot/dev
-	{"/dev", "/dev", "", mount.MS_BIND, "", 0755},
 }
 
-func poxCreate(names []string) error {
+// devDir is where the chroot's device nodes go, whichever --dev mode is in
+// use; poxCreate always makes sure it exists so there's somewhere to bind
+// mount or mknod into later.
+const devDir = "/dev"
+
+// devNode is one of the device nodes minimalDev creates inside the chroot
+// instead of bind-mounting the host's /dev, mirroring the set distrobuilder
+// materializes for its LXD VM target.
+type devNode struct {
+	name         string
+	major, minor uint32
+	perm         os.FileMode
+}
+
+var minimalDevNodes = []devNode{
+	{"null", 1, 3, 0666},
+	{"zero", 1, 5, 0666},
+	{"full", 1, 7, 0666},
+	{"random", 1, 8, 0666},
+	{"urandom", 1, 9, 0666},
+	{"tty", 5, 0, 0666},
+	{"console", 5, 1, 0600},
+}
+
+// minimalDev populates dir/dev with just the device nodes programs commonly
+// need, instead of bind mounting the host's /dev into the chroot.
+func minimalDev(dir string) error {
+	for _, n := range minimalDevNodes {
+		path := filepath.Join(dir, devDir, n.name)
+		if err := unix.Mknod(path, unix.S_IFCHR|uint32(n.perm), int(unix.Mkdev(n.major, n.minor))); err != nil {
+			return fmt.Errorf("mknod %v: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// devNodeFor adds a block device node for hostDev (e.g. the loop device, or
+// one of its partitions, backing a --target=vm pox) to dir/dev, so programs
+// inside the chroot that expect to find it, such as grub, can still open it
+// under --dev=minimal.
+func devNodeFor(dir, hostDev string) error {
+	var st unix.Stat_t
+	if err := unix.Stat(hostDev, &st); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, devDir, filepath.Base(hostDev))
+	return unix.Mknod(path, unix.S_IFBLK|0660, int(st.Rdev))
+}
+
+// enablePartscan turns on LO_FLAGS_PARTSCAN for the loop device at device,
+// which makes the kernel read its partition table and create the /dev/loopNpM
+// nodes (e.g. loopNp1) that --target=vm's single GPT partition is mounted
+// from.  loop.New doesn't ask for this itself, since the plain squashfs case
+// has no partition table to scan, so --target=vm has to turn it on by hand.
+func enablePartscan(device string) error {
+	fd, err := unix.Open(device, unix.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("opening %v to enable partscan: %v", device, err)
+	}
+	defer unix.Close(fd)
+
+	info, err := unix.IoctlLoopGetStatus64(fd)
+	if err != nil {
+		return fmt.Errorf("getting loop status for %v: %v", device, err)
+	}
+	info.Flags |= unix.LO_FLAGS_PARTSCAN
+	if err := unix.IoctlLoopSetStatus64(fd, info); err != nil {
+		return fmt.Errorf("enabling partscan on %v: %v", device, err)
+	}
+	return nil
+}
+
+// templateEntry is one file in a --template manifest: source is rendered as
+// a Go text/template and the result written to target inside the pox, at
+// whichever of "create" or "run" (or both) is listed in when.
+type templateEntry struct {
+	Source     string            `yaml:"source"`
+	Target     string            `yaml:"target"`
+	Mode       os.FileMode       `yaml:"mode"`
+	When       []string          `yaml:"when"`
+	Properties map[string]string `yaml:"properties"`
+}
+
+// templateManifest is the top-level shape of the YAML file --template
+// points at.
+type templateManifest struct {
+	Templates []templateEntry `yaml:"templates"`
+}
+
+// templateStageDir is where poxCreate stages the manifest and every
+// template it references inside the pox, so that "when: run" templates can
+// still be rendered later even though the original --template path, which
+// only exists on the machine that ran -c, is long gone by the time -r runs.
+const templateStageDir = "/.pox/templates"
+
+var templateManifestPath = filepath.Join(templateStageDir, "templates.yaml")
+
+// templateVars is what a template file sees as top-level fields, e.g.
+// {{.Pox.Name}}, {{.Host.Arch}}, {{.Env.USER}} and {{.Properties.foo}}.
+// Properties is set per manifest entry, from that entry's own "properties:"
+// map, just before it's rendered.
+type templateVars struct {
+	Pox        struct{ Name string }
+	Host       struct{ Arch string }
+	Env        map[string]string
+	Properties map[string]string
+}
+
+// newTemplateVars builds the variables available to a template rendering
+// for the pox that will end up at, or was loop-mounted from, file.
+func newTemplateVars(file string) templateVars {
+	var vars templateVars
+	vars.Pox.Name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	vars.Host.Arch = runtime.GOARCH
+	vars.Env = map[string]string{}
+	for _, kv := range os.Environ() {
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			vars.Env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return vars
+}
+
+// loadTemplateManifest parses the YAML file at path into a templateManifest.
+func loadTemplateManifest(path string) (*templateManifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m templateManifest
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("parsing template manifest %v: %v", path, err)
+	}
+	return &m, nil
+}
+
+// stageTemplates copies manifestPath and every source file m lists into
+// dir/templateStageDir, so they survive being packed into a squashfs or
+// disk image for later "when: run" rendering.
+func stageTemplates(dir, manifestPath string, m *templateManifest) error {
+	staged := filepath.Join(dir, templateStageDir)
+	if err := os.MkdirAll(staged, 0755); err != nil {
+		return err
+	}
+	if err := copyFile(manifestPath, filepath.Join(dir, templateManifestPath)); err != nil {
+		return err
+	}
+	srcDir := filepath.Dir(manifestPath)
+	for _, e := range m.Templates {
+		dst, err := safeJoin(staged, e.Source)
+		if err != nil {
+			return fmt.Errorf("template source %v: %v", e.Source, err)
+		}
+		if err := copyFile(filepath.Join(srcDir, e.Source), dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies src to dst, creating dst's parent directory and
+// preserving src's permissions.
+func copyFile(src, dst string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// safeJoin joins base and rel like filepath.Join, but fails if the result
+// would resolve outside base. A --template manifest travels with the pox,
+// so a hostile "source" or "target" entry such as "../../../etc/cron.d/x"
+// must not be able to make stageTemplates or renderTemplates write outside
+// the directory they're meant to be confined to.
+func safeJoin(base, rel string) (string, error) {
+	base = filepath.Clean(base)
+	joined := filepath.Join(base, rel)
+	if joined != base && !strings.HasPrefix(joined, base+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q escapes %v", rel, base)
+	}
+	return joined, nil
+}
+
+// hasWhen reports whether phase (e.g. "create" or "run") is one of e's when
+// entries.
+func (e templateEntry) hasWhen(phase string) bool {
+	for _, w := range e.When {
+		if w == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// renderTemplateFile renders the Go text/template at src into target with
+// vars, creating target's parent directory and using mode (0644 if unset).
+func renderTemplateFile(src, target string, mode os.FileMode, vars templateVars) error {
+	tmpl, err := template.ParseFiles(src)
+	if err != nil {
+		return fmt.Errorf("parsing template %v: %v", src, err)
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := tmpl.Execute(out, vars); err != nil {
+		return fmt.Errorf("rendering template %v into %v: %v", src, target, err)
+	}
+	return nil
+}
+
+// renderTemplates renders every entry of m whose when includes phase, with
+// sources staged under dir/templateStageDir, into their dir-relative
+// targets.
+func renderTemplates(dir string, m *templateManifest, phase string, vars templateVars) error {
+	for _, e := range m.Templates {
+		if !e.hasWhen(phase) {
+			continue
+		}
+		target, err := safeJoin(dir, e.Target)
+		if err != nil {
+			return fmt.Errorf("template target %v: %v", e.Target, err)
+		}
+		vars.Properties = e.Properties
+		src := filepath.Join(dir, templateStageDir, e.Source)
+		if err := renderTemplateFile(src, target, e.Mode, vars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func poxCreate(ctx context.Context, names []string) error {
 	if len(names) == 0 {
 		return fmt.Errorf(usage)
 	}
@@ -189,20 +549,46 @@ func poxCreate(names []string) error {
 			return err
 		}
 	}
+	if err := os.MkdirAll(filepath.Join(dir, devDir), 0755); err != nil {
+		return err
+	}
+
+	if *tmplManifest != "" {
+		tm, err := loadTemplateManifest(*tmplManifest)
+		if err != nil {
+			return fmt.Errorf("loading --template manifest %v: %v", *tmplManifest, err)
+		}
+		if err := stageTemplates(dir, *tmplManifest, tm); err != nil {
+			return err
+		}
+		if err := renderTemplates(dir, tm, "create", newTemplateVars(*file)); err != nil {
+			return err
+		}
+	}
+
 	err = os.Remove(*file)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
+
+	if targetVM() {
+		if err := writeVMImage(ctx, dir, *file); err != nil {
+			return err
+		}
+		v("Done, your pox is in %v", *file)
+		return nil
+	}
+
 	var c *exec.Cmd
 	if *zip {
 		fileAbs, err := filepath.Abs(*file)
 		if err != nil {
 			return err
 		}
-		c = exec.Command("zip", "-r", fileAbs, ".")
+		c = exec.CommandContext(ctx, "zip", "-r", fileAbs, ".")
 		c.Dir = dir
 	} else {
-		c = exec.Command("mksquashfs", dir, *file, "-noappend")
+		c = exec.CommandContext(ctx, "mksquashfs", dir, *file, "-noappend")
 	}
 	o, err := c.CombinedOutput()
 	v("%v", string(o))
@@ -214,20 +600,251 @@ func poxCreate(names []string) error {
 	return nil
 }
 
-func poxRun(args []string) error {
+// writeVMImage turns dir, a fully populated rootfs, into a bootable raw disk
+// image at file: a GPT partition table with a single root partition,
+// formatted with *fs, with the contents of dir copied in and GRUB installed
+// so the image can be booted directly under qemu.
+func writeVMImage(ctx context.Context, dir, file string) error {
+	var cleanup cleanupStack
+	defer cleanup.run()
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	sz, err := quantity(*size)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Truncate(sz); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if o, err := exec.CommandContext(ctx, "sgdisk", "-n", "1:0:0", "-t", "1:8300", file).CombinedOutput(); err != nil {
+		return fmt.Errorf("partitioning %v: %v: %v", file, string(o), err)
+	}
+
+	lo, err := loop.New(file, "", "")
+	if err != nil {
+		return err
+	}
+	cleanup.push(lo.Free)
+
+	if err := enablePartscan(lo.Device()); err != nil {
+		return err
+	}
+
+	part := lo.Device() + "p1"
+	if o, err := exec.CommandContext(ctx, "mkfs."+*fs, part).CombinedOutput(); err != nil {
+		return fmt.Errorf("mkfs.%v %v: %v: %v", *fs, part, string(o), err)
+	}
+
+	mdir, err := ioutil.TempDir("", "pox-vm")
+	if err != nil {
+		return err
+	}
+	cleanup.push(func() error { return os.RemoveAll(mdir) })
+
+	mp, err := mount.Mount(part, mdir, *fs, "", 0)
+	if err != nil {
+		return err
+	}
+	cleanup.push(func() error { return mp.Unmount(0) })
+
+	if o, err := exec.CommandContext(ctx, "cp", "-a", dir+"/.", mdir).CombinedOutput(); err != nil {
+		return fmt.Errorf("copying %v into %v: %v: %v", dir, mdir, string(o), err)
+	}
+
+	if o, err := exec.CommandContext(ctx, "grub-install", "--boot-directory="+filepath.Join(mdir, "boot"), lo.Device()).CombinedOutput(); err != nil {
+		return fmt.Errorf("grub-install on %v: %v: %v", lo.Device(), string(o), err)
+	}
+
+	return nil
+}
+
+func poxRun(ctx context.Context, args []string) error {
 	if len(args) == 0 {
 		return fmt.Errorf(usage)
 	}
+	if *userns {
+		// Loop devices (the default squashfs mount and --target=vm, which
+		// poxRunChroot picks over --zip whenever it's set) are attached
+		// against the initial user namespace's CAP_SYS_ADMIN, which being
+		// uid 0 inside our new user namespace does not grant; the same goes
+		// for --dev=minimal's unix.Mknod calls against the real host
+		// filesystem. --userns only avoids needing real root for the plain
+		// bind-mount-and-chroot path a --zip, non-vm pox takes, so require
+		// that here rather than fail confusingly partway through a loop
+		// mount.
+		if !*zip || targetVM() {
+			return fmt.Errorf("--userns requires --zip and not --target=vm: loop-mounting a squashfs or vm image needs real root, which --userns does not provide")
+		}
+		return poxRunUserns(ctx, args)
+	}
+	return poxRunChroot(ctx, args)
+}
+
+// poxRunUserns re-execs the pox binary as childArgv0 inside a new
+// user+mount+pid namespace, with the calling user mapped to uid/gid 0, so
+// that poxRunChroot's bind mounts and chroot can run without real root
+// privilege.  Callers must have already checked *zip: a loop-mounted
+// squashfs or vm image needs CAP_SYS_ADMIN over the host's loop devices,
+// which this namespace doesn't have.
+func poxRunUserns(ctx context.Context, args []string) error {
+	self, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return err
+	}
+	c := exec.CommandContext(ctx, self, args...)
+	c.Args[0] = childArgv0
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	c.Env = append(os.Environ(),
+		envFile+"="+*file,
+		fmt.Sprintf("%v=%v", envZip, *zip),
+		envTarget+"="+*target,
+		envFS+"="+*fs,
+		envDev+"="+*dev,
+	)
+	c.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+	}
+	return c.Run()
+}
+
+// poxChild is run by main when argv[0] == childArgv0: it's the re-exec'd
+// process from poxRunUserns, now "root" inside its own user namespace, with
+// *file and *zip restored from the environment poxRunUserns set.
+func poxChild(ctx context.Context, args []string) error {
+	*file = os.Getenv(envFile)
+	*zip = os.Getenv(envZip) == "true"
+	*target = os.Getenv(envTarget)
+	*fs = os.Getenv(envFS)
+	*dev = os.Getenv(envDev)
+	return poxRunChroot(ctx, args)
+}
+
+// renderRunTemplates renders every "when: run" entry of the --template
+// manifest poxCreate staged at dir/templateManifestPath, if there is one.
+// Since the rootfs mounted at dir may be a read-only squashfs, each target's
+// parent directory is overlaid with a tmpfs, pushed onto cleanup so it's torn
+// down again once the chrooted command exits; the directory's existing
+// entries (e.g. the rest of /etc) are copied into the tmpfs before the
+// template is rendered on top, so only the templated file itself changes for
+// the duration of the run.
+func renderRunTemplates(ctx context.Context, dir string, cleanup *cleanupStack) error {
+	manifestPath := filepath.Join(dir, templateManifestPath)
+	if _, err := os.Stat(manifestPath); os.IsNotExist(err) {
+		return nil
+	}
+	m, err := loadTemplateManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	vars := newTemplateVars(*file)
+	overlaid := map[string]bool{}
+	for _, e := range m.Templates {
+		if !e.hasWhen("run") {
+			continue
+		}
+		target, err := safeJoin(dir, e.Target)
+		if err != nil {
+			return fmt.Errorf("template target %v: %v", e.Target, err)
+		}
+		parent := filepath.Dir(target)
+		if !overlaid[parent] {
+			if err := overlayWithTmpfs(ctx, parent, cleanup); err != nil {
+				return fmt.Errorf("overlaying %v for run templates: %v", parent, err)
+			}
+			overlaid[parent] = true
+		}
+		vars.Properties = e.Properties
+		src := filepath.Join(dir, templateStageDir, e.Source)
+		if err := renderTemplateFile(src, target, e.Mode, vars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// overlayWithTmpfs mounts a tmpfs over parent, pushed onto cleanup so it's
+// unmounted again once the caller is done with it, preserving parent's
+// existing entries by staging a copy of them beforehand and copying them
+// back in once the tmpfs is mounted. Without this, mounting a bare tmpfs
+// over parent would shadow every file already there, not just the ones the
+// caller goes on to overwrite.
+func overlayWithTmpfs(ctx context.Context, parent string, cleanup *cleanupStack) error {
+	staged, err := ioutil.TempDir("", "pox-overlay")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staged)
+
+	if o, err := exec.CommandContext(ctx, "cp", "-a", parent+"/.", staged).CombinedOutput(); err != nil {
+		return fmt.Errorf("staging existing contents of %v: %v: %v", parent, string(o), err)
+	}
+
+	mp, err := mount.Mount("tmpfs", parent, "tmpfs", "", 0)
+	if err != nil {
+		return err
+	}
+	cleanup.push(func() error { return mp.Unmount(0) })
+
+	if o, err := exec.CommandContext(ctx, "cp", "-a", staged+"/.", parent).CombinedOutput(); err != nil {
+		return fmt.Errorf("restoring existing contents of %v: %v: %v", parent, string(o), err)
+	}
+	return nil
+}
+
+// poxRunChroot does the actual work of mounting the pox and running args[0]
+// chrooted into it; it's used both directly, and by poxChild once
+// poxRunUserns has set up the new namespace.  cleanup unwinds the mount
+// stack in reverse once c.Run() returns, whether that's because args[0]
+// exited on its own or because ctx was cancelled out from under it.
+func poxRunChroot(ctx context.Context, args []string) error {
+	var cleanup cleanupStack
+	defer cleanup.run()
+
 	dir, err := ioutil.TempDir("", "pox")
 	if err != nil {
 		return err
 	}
 	if !*debug {
-		defer os.RemoveAll(dir)
+		cleanup.push(func() error { return os.RemoveAll(dir) })
 	}
 
-	if *zip {
-		c := exec.Command("unzip", *file, "-d", dir)
+	// loopDevs, for --target=vm, are the loop device and the partition
+	// backing the pox; under --dev=minimal we give the chroot a node for each
+	// alongside the rest.
+	var loopDevs []string
+	if targetVM() {
+		lo, err := loop.New(*file, "", "")
+		if err != nil {
+			return err
+		}
+		cleanup.push(lo.Free)
+
+		if err := enablePartscan(lo.Device()); err != nil {
+			return err
+		}
+
+		part := lo.Device() + "p1"
+		loopDevs = []string{lo.Device(), part}
+		mountPoint, err := mount.Mount(part, dir, *fs, "", 0)
+		if err != nil {
+			return err
+		}
+		cleanup.push(func() error { return mountPoint.Unmount(0) })
+	} else if *zip {
+		c := exec.CommandContext(ctx, "unzip", *file, "-d", dir)
 		o, err := c.CombinedOutput()
 		v("%v", string(o))
 		if err != nil {
@@ -238,13 +855,13 @@ func poxRun(args []string) error {
 		if err != nil {
 			return err
 		}
-		defer lo.Free() //nolint:errcheck
+		cleanup.push(lo.Free)
 
 		mountPoint, err := lo.Mount(dir, 0)
 		if err != nil {
 			return err
 		}
-		defer mountPoint.Unmount(0) //nolint:errcheck
+		cleanup.push(func() error { return mountPoint.Unmount(0) })
 	}
 	for _, m := range chrootMounts {
 		mp, err := mount.Mount(m.source, filepath.Join(dir, m.target),
@@ -252,7 +869,38 @@ func poxRun(args []string) error {
 		if err != nil {
 			return err
 		}
-		defer mp.Unmount(0) //nolint:errcheck
+		cleanup.push(func() error { return mp.Unmount(0) })
+	}
+	switch *dev {
+	case "bind":
+		mp, err := mount.Mount("/dev", filepath.Join(dir, devDir), "", "", mount.MS_BIND)
+		if err != nil {
+			return err
+		}
+		cleanup.push(func() error { return mp.Unmount(0) })
+	case "minimal":
+		// The pox may be a read-only squashfs, so the nodes go into a tmpfs
+		// mounted over its /dev rather than into the pox itself.
+		mp, err := mount.Mount("tmpfs", filepath.Join(dir, devDir), "tmpfs", "", 0)
+		if err != nil {
+			return err
+		}
+		cleanup.push(func() error { return mp.Unmount(0) })
+		if err := minimalDev(dir); err != nil {
+			return err
+		}
+		for _, d := range loopDevs {
+			if err := devNodeFor(dir, d); err != nil {
+				return err
+			}
+		}
+	case "none":
+	default:
+		return fmt.Errorf("--dev must be bind, minimal, or none, got %q", *dev)
+	}
+
+	if err := renderRunTemplates(ctx, dir, &cleanup); err != nil {
+		return err
 	}
 
 	// If you pass Command a path with no slashes, it'll use PATH from the
@@ -263,13 +911,17 @@ func poxRun(args []string) error {
 	if filepath.Base(args[0]) == args[0] {
 		args[0] = filepath.Join(string(os.PathSeparator), "bin", args[0])
 	}
-	c := exec.Command(args[0], args[1:]...)
+	c := exec.CommandContext(ctx, args[0], args[1:]...)
 	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
 	c.SysProcAttr = &syscall.SysProcAttr{
 		Chroot: dir,
 	}
 	c.Env = append(os.Environ(), "PWD=.")
 
+	// exec.CommandContext kills args[0] the moment ctx is cancelled (by
+	// --timeout or a signal), which unblocks c.Run() below and lets the
+	// cleanup stack above unwind deterministically instead of leaving
+	// mounts and loop devices attached under a hung chroot.
 	if err = c.Run(); err != nil {
 		v("pox command exited with: %v", err)
 	}
@@ -277,7 +929,7 @@ func poxRun(args []string) error {
 	return nil
 }
 
-func pox() error {
+func pox(ctx context.Context) error {
 	flag.Parse()
 	if *debug {
 		v = log.Printf
@@ -285,17 +937,44 @@ func pox() error {
 	if (*create && *run) || (!*create && !*run) {
 		return fmt.Errorf(usage)
 	}
+	if *target != "squashfs" && *target != "vm" {
+		return fmt.Errorf("--target must be squashfs or vm, got %q", *target)
+	}
+	if *dev != "bind" && *dev != "minimal" && *dev != "none" {
+		return fmt.Errorf("--dev must be bind, minimal, or none, got %q", *dev)
+	}
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
 	if *create {
-		return poxCreate(flag.Args())
+		return poxCreate(ctx, flag.Args())
 	}
 	if *run {
-		return poxRun(flag.Args())
+		return poxRun(ctx, flag.Args())
 	}
 	return fmt.Errorf(usage)
 }
 
 func main() {
-	if err := pox(); err != nil {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		cancel()
+	}()
+
+	if filepath.Base(os.Args[0]) == childArgv0 {
+		if err := poxChild(ctx, os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := pox(ctx); err != nil {
 		log.Fatal(err)
 	}
 }
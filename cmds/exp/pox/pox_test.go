@@ -0,0 +1,133 @@
+// Copyright 2012-2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuantity(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "512", want: 512},
+		{in: "512K", want: 512 << 10},
+		{in: "512M", want: 512 << 20},
+		{in: "2G", want: 2 << 30},
+		{in: "0", want: 0},
+		{in: "512MB", wantErr: true},
+		{in: "2Gi", wantErr: true},
+		{in: "abc", wantErr: true},
+		{in: "", wantErr: true},
+	} {
+		got, err := quantity(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("quantity(%q) = %v, nil, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("quantity(%q) unexpected error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("quantity(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTemplateEntryHasWhen(t *testing.T) {
+	for _, tt := range []struct {
+		when  []string
+		phase string
+		want  bool
+	}{
+		{when: []string{"create"}, phase: "create", want: true},
+		{when: []string{"create"}, phase: "run", want: false},
+		{when: []string{"create", "run"}, phase: "run", want: true},
+		{when: nil, phase: "create", want: false},
+	} {
+		e := templateEntry{When: tt.when}
+		if got := e.hasWhen(tt.phase); got != tt.want {
+			t.Errorf("templateEntry{When: %v}.hasWhen(%q) = %v, want %v", tt.when, tt.phase, got, tt.want)
+		}
+	}
+}
+
+func TestCleanupStackRun(t *testing.T) {
+	var order []int
+	var c cleanupStack
+	c.push(func() error { order = append(order, 1); return nil })
+	c.push(func() error { order = append(order, 2); return errors.New("boom") })
+	c.push(func() error { order = append(order, 3); return nil })
+
+	c.run()
+
+	want := []int{3, 2, 1}
+	if len(order) != len(want) {
+		t.Fatalf("run() executed steps %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Errorf("run() executed steps %v, want %v", order, want)
+			break
+		}
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	for _, tt := range []struct {
+		base    string
+		rel     string
+		wantErr bool
+	}{
+		{base: "/pox/root", rel: "etc/hostname", wantErr: false},
+		{base: "/pox/root", rel: "./etc/hostname", wantErr: false},
+		{base: "/pox/root", rel: ".", wantErr: false},
+		{base: "/pox/root", rel: "../../../etc/cron.d/x", wantErr: true},
+		{base: "/pox/root", rel: "../root-but-not-really", wantErr: true},
+	} {
+		got, err := safeJoin(tt.base, tt.rel)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("safeJoin(%q, %q) = %v, nil, want error", tt.base, tt.rel, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("safeJoin(%q, %q) unexpected error: %v", tt.base, tt.rel, err)
+		}
+	}
+}
+
+func TestDevNodeForMissingHostDevice(t *testing.T) {
+	dir := t.TempDir()
+	if err := devNodeFor(dir, filepath.Join(dir, "no-such-device")); err == nil {
+		t.Error("devNodeFor with a nonexistent host device = nil error, want error")
+	}
+}
+
+func TestDevNodeForPath(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mknod requires root")
+	}
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, devDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := devNodeFor(dir, "/dev/null"); err != nil {
+		t.Skipf("mknod not permitted in this environment: %v", err)
+	}
+	path := filepath.Join(dir, devDir, "null")
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("devNodeFor did not create %v: %v", path, err)
+	}
+}